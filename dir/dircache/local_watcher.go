@@ -0,0 +1,175 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+// This file defines LocalWatcher, a pluggable source of synthetic
+// upspin.Events generated by watching a locally-mounted copy of a user's
+// tree (for instance one exported by upspinfs) for changes. Reflecting
+// those edits into the LRU as they happen means a locally-modified file
+// need not wait for the round trip through the DirServer's own Watch
+// stream before the cache agrees with what's on disk.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// LocalWatcher watches a single local directory tree, rooted where some
+// other part of the system (typically upspinfs) has mounted a user's
+// files, and reports changes under it as upspin.Events. Implementations
+// watch recursively and keep doing so until Close is called.
+//
+// Events produced by a LocalWatcher carry no meaningful Order; there is
+// no server log position for a purely local edit. handleLocalEvent
+// merges them in without disturbing the order used to resume the
+// server-side Watch.
+type LocalWatcher interface {
+	// Watch begins observing root, the local path backing user's tree,
+	// and sends an event for every change seen under it from then on.
+	// The returned channel is closed when the watch ends, whether
+	// because of Close or an unrecoverable error.
+	Watch(root string, user upspin.UserName) (<-chan upspin.Event, error)
+
+	// Close stops every outstanding watch started by Watch.
+	Close() error
+}
+
+// fsnotifyWatcher is the default LocalWatcher. It is backed by fsnotify,
+// which in turn uses inotify, kqueue, FSEvents, or
+// ReadDirectoryChangesW, whichever the host platform provides.
+type fsnotifyWatcher struct {
+	mu    sync.Mutex
+	watch []fsnotifyWatch
+}
+
+// fsnotifyWatch is everything Close needs to tear down one outstanding
+// Watch call: the underlying fsnotify.Watcher, and the stop channel
+// that unblocks its translator goroutine if it's parked sending an
+// event nobody is receiving yet.
+type fsnotifyWatch struct {
+	w    *fsnotify.Watcher
+	stop chan struct{}
+}
+
+// NewLocalWatcher returns the default, fsnotify-backed LocalWatcher.
+func NewLocalWatcher() LocalWatcher {
+	return &fsnotifyWatcher{}
+}
+
+// Watch implements LocalWatcher.
+func (f *fsnotifyWatcher) Watch(root string, user upspin.UserName) (<-chan upspin.Event, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := addTree(w, root); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	f.mu.Lock()
+	f.watch = append(f.watch, fsnotifyWatch{w: w, stop: stop})
+	f.mu.Unlock()
+
+	events := make(chan upspin.Event)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				// fsnotify watches are not recursive; a directory
+				// created under one we're already watching needs its
+				// own Add so files created inside it are seen too.
+				if ev.Op&fsnotify.Create != 0 {
+					if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+						if err := addTree(w, ev.Name); err != nil {
+							log.Info.Printf("dircache.LocalWatcher %s: %s", ev.Name, err)
+						}
+					}
+				}
+				e, ok := fsEventToUpspin(root, user, ev)
+				if !ok {
+					continue
+				}
+				// events has no reader once whatever was consuming it
+				// (watch's select in proxied.go) has moved on, which
+				// can happen at any time relative to a pending fsnotify
+				// event; without this second case the send below blocks
+				// forever and the goroutine leaks.
+				select {
+				case events <- e:
+				case <-stop:
+					return
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Info.Printf("dircache.LocalWatcher %s: %s", root, err)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// addTree adds root and every directory beneath it to w. fsnotify
+// watches are non-recursive, so observing an entire tree means adding
+// each of its directories individually.
+func addTree(w *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		return w.Add(path)
+	})
+}
+
+// Close implements LocalWatcher.
+func (f *fsnotifyWatcher) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var firstErr error
+	for _, fw := range f.watch {
+		close(fw.stop)
+		if err := fw.w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.watch = nil
+	return firstErr
+}
+
+// fsEventToUpspin translates a local filesystem notification, rooted at
+// root and backing user's tree, into the synthetic upspin.Event that
+// handleLocalEvent expects. It reports false for events worth ignoring,
+// such as bare attribute changes.
+func fsEventToUpspin(root string, user upspin.UserName, ev fsnotify.Event) (upspin.Event, bool) {
+	if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+		return upspin.Event{}, false
+	}
+	suffix := strings.TrimPrefix(ev.Name, root)
+	name := upspin.PathName(string(user) + "/" + strings.TrimPrefix(suffix, "/"))
+	e := upspin.Event{
+		Entry:  &upspin.DirEntry{Name: name},
+		Delete: ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0,
+	}
+	return e, true
+}
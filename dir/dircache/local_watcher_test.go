@@ -0,0 +1,185 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+// fakeLocalWatcher is a LocalWatcher whose events are driven directly by
+// a test, rather than by an actual filesystem notifier.
+type fakeLocalWatcher struct {
+	events chan upspin.Event
+	closed bool
+}
+
+func newFakeLocalWatcher() *fakeLocalWatcher {
+	return &fakeLocalWatcher{events: make(chan upspin.Event, 10)}
+}
+
+func (f *fakeLocalWatcher) Watch(root string, user upspin.UserName) (<-chan upspin.Event, error) {
+	return f.events, nil
+}
+
+func (f *fakeLocalWatcher) Close() error {
+	if !f.closed {
+		f.closed = true
+		close(f.events)
+	}
+	return nil
+}
+
+// edit sends a synthetic local edit of name through the watcher.
+func (f *fakeLocalWatcher) edit(name upspin.PathName) {
+	f.events <- upspin.Event{Entry: &upspin.DirEntry{Name: name}}
+}
+
+// TestLocalWatcherMergesEditsIntoLRU simulates a sequence of rapid local
+// edits to a file already cached in the LRU and confirms each one
+// evicts the stale cached entry, without touching d.order, which is
+// reserved for the server's Watch stream. A LocalWatcher only knows
+// that a file changed, not its new content, so handleLocalEvent must
+// not leave a hollow DirEntry behind for Lookup to serve.
+func TestLocalWatcherMergesEditsIntoLRU(t *testing.T) {
+	const (
+		user upspin.UserName = "joe@upspin.io"
+		name                 = upspin.PathName(user + "/file")
+	)
+	l, err := newClog(config.New(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newClog: %s", err)
+	}
+	defer l.close()
+
+	d := &proxiedDir{l: l, user: user, order: 42}
+
+	key := lruKey{name: name, glob: false}
+
+	fake := newFakeLocalWatcher()
+	d.startLocalWatch("/mnt/joe", fake)
+	if d.local == nil {
+		t.Fatal("startLocalWatch did not record the LocalWatcher")
+	}
+
+	const edits = 5
+	for i := 0; i < edits; i++ {
+		// Re-seed the LRU before each edit, the way a real lookup
+		// would have cached the file's previous contents, so we can
+		// confirm handleLocalEvent evicts it every time rather than
+		// just the first.
+		d.l.lru.Add(key, "stale contents")
+		fake.edit(name)
+
+		select {
+		case e := <-d.localEvents:
+			if err := d.handleLocalEvent(&e); err != nil {
+				t.Fatalf("handleLocalEvent: %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for local edit %d", i)
+		}
+
+		if _, ok := d.l.lru.Get(key); ok {
+			t.Fatalf("edit %d: LRU entry survived handleLocalEvent; Lookup could serve stale or hollow content", i)
+		}
+	}
+
+	if d.order != 42 {
+		t.Errorf("order = %d, want unchanged at 42; local events must not advance it", d.order)
+	}
+}
+
+// TestFsnotifyWatcherIsRecursive confirms that fsnotifyWatcher, the real
+// LocalWatcher, sees edits to files nested in subdirectories that
+// already existed when Watch started, and to files in a subdirectory
+// created afterwards.
+func TestFsnotifyWatcherIsRecursive(t *testing.T) {
+	const user upspin.UserName = "joe@upspin.io"
+
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "existing"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	w := NewLocalWatcher()
+	events, err := w.Watch(root, user)
+	if err != nil {
+		t.Fatalf("Watch: %s", err)
+	}
+	defer w.Close()
+
+	waitFor := func(name upspin.PathName) {
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					t.Fatal("event channel closed early")
+				}
+				if e.Entry.Name == name {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for an event on %s", name)
+			}
+		}
+	}
+
+	existing := filepath.Join(root, "existing", "file")
+	if err := ioutil.WriteFile(existing, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(upspin.PathName(user + "/existing/file"))
+
+	fresh := filepath.Join(root, "fresh")
+	if err := os.Mkdir(fresh, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(fresh, "file"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(upspin.PathName(user + "/fresh/file"))
+}
+
+// TestFsnotifyWatcherCloseUnblocksPendingSend confirms that Close
+// returns promptly, and doesn't leak the translator goroutine, even
+// when that goroutine is parked trying to deliver an event nobody is
+// reading from the Watch channel.
+func TestFsnotifyWatcherCloseUnblocksPendingSend(t *testing.T) {
+	const user upspin.UserName = "joe@upspin.io"
+
+	root := t.TempDir()
+	w := NewLocalWatcher()
+	_, err := w.Watch(root, user)
+	if err != nil {
+		t.Fatalf("Watch: %s", err)
+	}
+
+	// Generate an event and give the translator goroutine time to read
+	// it from fsnotify and block trying to send it on events, which
+	// nothing here ever reads from.
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- w.Close() }()
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return; translator goroutine is stuck on an unread send")
+	}
+}
@@ -39,7 +39,35 @@ type proxiedDir struct {
 	die   chan bool // channel used to tell watcher to die
 	dying chan bool // channel used to confirm watcher is dying
 
+	// attachLocal hands a newly-known local root to a running watcher.
+	// SetLocalRoot sends on it rather than writing localRoot/local/
+	// localEvents directly, since those fields are otherwise only ever
+	// touched by the watcher goroutine itself, with no lock of its
+	// own; see watch's select loop.
+	attachLocal chan string
+
 	retryInterval time.Duration
+
+	// reaped is set by the idle-watcher reaper when it shuts down this
+	// directory's watcher and evicts its LRU entries for inactivity.
+	// It tells the next proxyFor to force a full re-read, since the
+	// cached state it would otherwise resume from is gone.
+	reaped bool
+
+	// refreshInterval is how often watch pings the DirServer to assert
+	// liveness of the outstanding Watch subscription. Zero means use
+	// defaultRefreshInterval.
+	refreshInterval time.Duration
+
+	// localRoot, if set, is the local path of a mounted copy of this
+	// user's tree (e.g. an upspinfs mount point). When set, the
+	// watcher also asks local for synthetic events from edits made
+	// directly to that mount, so the LRU doesn't have to wait for a
+	// round trip through the DirServer's Watch stream.
+	localRoot       string
+	local           LocalWatcher
+	localEvents     <-chan upspin.Event
+	newLocalWatcher func() LocalWatcher // overridden in tests; defaults to NewLocalWatcher
 }
 
 // proxiedDirs is used to translate between a user name and the relevant cached directory.
@@ -49,10 +77,72 @@ type proxiedDirs struct {
 	closing bool // when this is true do not allocate any new watchers
 	l       *clog
 	m       map[upspin.UserName]*proxiedDir
+
+	// newLocalWatcher builds the LocalWatcher used to observe a user's
+	// local mount point, if any. It is a field, rather than a direct
+	// call to NewLocalWatcher, so tests can supply a fake backend.
+	newLocalWatcher func() LocalWatcher
+
+	cfg      Config
+	now      func() time.Time // overridden in tests
+	reapDone chan struct{}
+}
+
+func newProxiedDirs(l *clog, cfg Config) *proxiedDirs {
+	cfg.setDefaults()
+	p := &proxiedDirs{
+		m:               make(map[upspin.UserName]*proxiedDir),
+		l:               l,
+		newLocalWatcher: NewLocalWatcher,
+		cfg:             cfg,
+		now:             time.Now,
+		reapDone:        make(chan struct{}),
+	}
+	go p.reap()
+	return p
 }
 
-func newProxiedDirs(l *clog) *proxiedDirs {
-	return &proxiedDirs{m: make(map[upspin.UserName]*proxiedDir), l: l}
+// newProxiedDir allocates a proxiedDir for user, carrying over whatever
+// of p's configuration a proxiedDir needs to know about itself.
+func (p *proxiedDirs) newProxiedDir(user upspin.UserName) *proxiedDir {
+	return &proxiedDir{
+		l:               p.l,
+		user:            user,
+		newLocalWatcher: p.newLocalWatcher,
+		refreshInterval: p.cfg.RefreshInterval,
+	}
+}
+
+// SetLocalRoot records that user's tree is also mounted locally at root,
+// and, if a watcher is already running for user, starts observing it for
+// local edits. It is called by whatever mounts a user's tree locally
+// (such as upspinfs) once the mount point is known.
+func (p *proxiedDirs) SetLocalRoot(user upspin.UserName, root string) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closing {
+		return
+	}
+	d := p.m[user]
+	if d == nil {
+		d = p.newProxiedDir(user)
+		p.m[user] = d
+	}
+	if d.die == nil {
+		// No watcher running yet to race with; it reads localRoot
+		// itself, from its own goroutine, once it starts.
+		d.localRoot = root
+		return
+	}
+	// A watcher is already running. Hand it the new root through
+	// attachLocal instead of starting the local watch here: only the
+	// watcher goroutine touches localRoot/local/localEvents once it's
+	// running, the same way only it touches die.
+	select {
+	case <-d.attachLocal:
+	default:
+	}
+	d.attachLocal <- root
 }
 
 // close terminates all watchers.
@@ -63,6 +153,7 @@ func (p *proxiedDirs) close() {
 		return
 	}
 	p.closing = true
+	close(p.reapDone)
 	for _, d := range p.m {
 		d.close()
 	}
@@ -91,21 +182,27 @@ func (p *proxiedDirs) proxyFor(name upspin.PathName, ep *upspin.Endpoint) {
 	}
 
 	if d == nil {
-		d = &proxiedDir{l: p.l, ep: *ep, user: u}
+		d = p.newProxiedDir(u)
+		d.ep = *ep
 		p.m[u] = d
 	}
 
-	// Remember when we last accessed this proxied directory.
-	// TODO: Use this time to stop listening to directories we
-	// haven't looked at in a long time. We will also have to
-	// forget about cached information for them if we stop
-	// watching.
-	d.atime = time.Now()
+	// Remember when we last accessed this proxied directory; the
+	// reaper uses this to stop listening to directories we haven't
+	// looked at in a long time.
+	d.atime = p.now()
 
 	// Start a watcher if none is running.
 	if d.die == nil {
+		if d.reaped {
+			// Our cached state was evicted while idle; read it
+			// all back in rather than resuming from d.order.
+			d.order = -1
+			d.reaped = false
+		}
 		d.die = make(chan bool)
 		d.dying = make(chan bool)
+		d.attachLocal = make(chan string, 1)
 		go d.watcher(*ep)
 	}
 }
@@ -126,7 +223,7 @@ func (p *proxiedDirs) setOrder(name upspin.PathName, order int64) {
 	u := parsed.User()
 	d := p.m[u]
 	if d == nil {
-		d = &proxiedDir{l: p.l, user: u}
+		d = p.newProxiedDir(u)
 		p.m[u] = d
 	}
 	d.order = order
@@ -139,6 +236,74 @@ func (d *proxiedDir) close() {
 		<-d.dying
 		d.die = nil
 	}
+	if d.local != nil {
+		d.local.Close()
+		d.local = nil
+	}
+}
+
+// closeAsync signals d's watcher to die without waiting for it to
+// actually exit, unlike close. The watcher may be stuck inside
+// dir.Watch's initial RPC, which has no deadline or cancellation wired
+// to d.die (see watch in this file), so waiting here could block the
+// caller forever; reapOnce calls this while holding p's lock, which
+// guards every other proxiedDirs method.
+//
+// d.die and d.local are only ever read by the watcher goroutine before
+// it observes the close and returns, so they can't be touched here
+// until that return is confirmed: the callback below waits for it,
+// then clears them under p's lock, the same way close does. Until then
+// d still looks alive to proxyFor, so a racing access won't restart a
+// new watcher out from under the dying one; it will once the old one
+// has actually gone.
+func (p *proxiedDirs) closeAsync(d *proxiedDir) {
+	if d.die == nil {
+		return
+	}
+	die, dying := d.die, d.dying
+	close(die)
+	go func() {
+		<-dying
+		p.Lock()
+		local := d.local
+		if d.die == die {
+			d.die = nil
+			d.local = nil
+		}
+		p.Unlock()
+		if local != nil {
+			local.Close()
+		}
+	}()
+}
+
+// startLocalWatch begins watching root with local, merging the events
+// it produces with the server-side Watch stream already being read by
+// d.watch. It is a no-op if root is empty. Only called from the
+// watcher goroutine, so it's the only thing that ever writes localRoot,
+// local, and localEvents while a watcher is running.
+func (d *proxiedDir) startLocalWatch(root string, local LocalWatcher) {
+	if root == "" {
+		return
+	}
+	events, err := local.Watch(root, d.user)
+	if err != nil {
+		log.Info.Printf("dircache.startLocalWatch %s: %s", root, err)
+		return
+	}
+	d.localRoot = root
+	d.local = local
+	d.localEvents = events
+}
+
+// newLocalWatcherOrDefault returns a new instance of d's configured
+// LocalWatcher, falling back to the package default if none was set.
+func (d *proxiedDir) newLocalWatcherOrDefault() LocalWatcher {
+	newLocalWatcher := d.newLocalWatcher
+	if newLocalWatcher == nil {
+		newLocalWatcher = NewLocalWatcher
+	}
+	return newLocalWatcher()
 }
 
 const (
@@ -157,6 +322,10 @@ func (d *proxiedDir) watcher(ep upspin.Endpoint) {
 		d.order = -1
 	}
 
+	if d.localRoot != "" && d.local == nil {
+		d.startLocalWatch(d.localRoot, d.newLocalWatcherOrDefault())
+	}
+
 	d.retryInterval = initialRetryInterval
 	for {
 		err := d.watch(ep)
@@ -171,6 +340,15 @@ func (d *proxiedDir) watcher(ep upspin.Endpoint) {
 			log.Debug.Printf("dir/dircache.watcher: %s: %s", d.user, err)
 			return
 		}
+		if err == errRefreshLeaseExpired {
+			// The server didn't answer two refreshes in a row; it may
+			// have failed over or dropped us silently behind a NAT or
+			// proxy. Reconnect right away, at the order we left off,
+			// rather than waiting out a TCP timeout.
+			log.Info.Printf("dir/dircache.watcher: %s: refresh lease expired, restarting Watch", d.user)
+			d.retryInterval = initialRetryInterval
+			continue
+		}
 		if strings.Contains(err.Error(), "cannot read log at order") {
 			// Reread current state.
 			d.order = -1
@@ -202,7 +380,18 @@ func (d *proxiedDir) watch(ep upspin.Endpoint) error {
 	// If Watch succeeds, go back to the initial interval.
 	d.retryInterval = initialRetryInterval
 
+	refreshInterval := d.refreshInterval
+	if refreshInterval == 0 {
+		refreshInterval = defaultRefreshInterval
+	}
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	refreshFailures := 0
+
 	// Loop receiving events until we are told to stop or the event stream is closed.
+	// Server events and, if this user's tree is also mounted locally,
+	// synthetic local-edit events are merged here as they arrive; both
+	// funnel through to the same LRU.
 	for {
 		select {
 		case <-d.die:
@@ -214,6 +403,31 @@ func (d *proxiedDir) watch(ep upspin.Endpoint) error {
 			if err := d.handleEvent(&e); err != nil {
 				return err
 			}
+		case e, ok := <-d.localEvents:
+			if !ok {
+				// The local watcher gave up; keep serving the
+				// DirServer's Watch stream on its own.
+				d.local = nil
+				d.localEvents = nil
+				continue
+			}
+			if err := d.handleLocalEvent(&e); err != nil {
+				log.Info.Printf("dir/dircache.watch: local event for %s: %s", d.user, err)
+			}
+		case root := <-d.attachLocal:
+			if d.local == nil {
+				d.startLocalWatch(root, d.newLocalWatcherOrDefault())
+			}
+		case <-refresh.C:
+			if err := refreshWatch(dir, d.user, d.order); err != nil {
+				refreshFailures++
+				log.Info.Printf("dir/dircache.watch: refresh failed for %s: %s", d.user, err)
+				if refreshFailures >= 2 {
+					return errRefreshLeaseExpired
+				}
+				continue
+			}
+			refreshFailures = 0
 		}
 	}
 }
@@ -230,21 +444,8 @@ func (d *proxiedDir) handleEvent(e *upspin.Event) error {
 	}
 	log.Debug.Printf("watch entry %s %v", e.Entry.Name, e)
 
-	// Is this a file we are watching? We always watch Access files since ones we never
-	// saw before can affect our cached state.
-	if !access.IsAccessFile(e.Entry.Name) {
-		_, ok := d.l.lru.Get(lruKey{name: e.Entry.Name, glob: false})
-		if !ok {
-			// Not a file we are watching, how about in a directory we are watching?
-			dirName := path.DropPath(e.Entry.Name, 1)
-			if dirName == e.Entry.Name {
-				return nil
-			}
-			_, ok := d.l.lru.Get(lruKey{name: dirName, glob: true})
-			if !ok {
-				return nil
-			}
-		}
+	if !d.watching(e.Entry.Name) {
+		return nil
 	}
 
 	// This is an event we care about.
@@ -257,3 +458,51 @@ func (d *proxiedDir) handleEvent(e *upspin.Event) error {
 	d.l.flush()
 	return nil
 }
+
+// handleLocalEvent processes a synthetic event produced by a
+// LocalWatcher. Unlike handleEvent it never advances d.order: a purely
+// local edit has no server log position, and leaving d.order alone
+// means the next real server event still merges in at the right spot,
+// and a restarted server Watch still resumes from where it left off.
+func (d *proxiedDir) handleLocalEvent(e *upspin.Event) error {
+	if e.Error != nil {
+		return e.Error
+	}
+	log.Debug.Printf("local watch entry %s %v", e.Entry.Name, e)
+
+	if !d.watching(e.Entry.Name) {
+		return nil
+	}
+
+	if e.Delete {
+		d.l.logRequestWithOrder(deleteReq, e.Entry.Name, nil, e.Entry, d.order)
+		d.l.flush()
+		return nil
+	}
+
+	// e.Entry carries no real content: a LocalWatcher only knows that
+	// something under root changed, not what it now contains, so
+	// caching it as a lookupReq result would poison the LRU with a
+	// hollow DirEntry. Evict the stale entry instead, so the next real
+	// Lookup falls through to the DirServer.
+	d.l.lru.Remove(lruKey{name: e.Entry.Name, glob: false})
+	return nil
+}
+
+// watching reports whether name is a file we are caching, or lives in a
+// directory we are caching. We always watch Access files since ones we
+// never saw before can affect our cached state.
+func (d *proxiedDir) watching(name upspin.PathName) bool {
+	if access.IsAccessFile(name) {
+		return true
+	}
+	if _, ok := d.l.lru.Get(lruKey{name: name, glob: false}); ok {
+		return true
+	}
+	dirName := path.DropPath(name, 1)
+	if dirName == name {
+		return false
+	}
+	_, ok := d.l.lru.Get(lruKey{name: dirName, glob: true})
+	return ok
+}
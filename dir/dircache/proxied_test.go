@@ -0,0 +1,63 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+import (
+	"testing"
+	"time"
+
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+// TestSetLocalRootAttachesToRunningWatcher drives SetLocalRoot against a
+// watcher that is already running (the normal flow when a mount point
+// becomes known after the fact), rather than calling startLocalWatch
+// directly as TestLocalWatcherMergesEditsIntoLRU does. SetLocalRoot must
+// hand the attach off to the watcher goroutine rather than touching
+// d.local/d.localEvents itself, since those are read unsynchronized by
+// watch's select loop.
+func TestSetLocalRootAttachesToRunningWatcher(t *testing.T) {
+	const (
+		user upspin.UserName = "joe@upspin.io"
+		name                 = upspin.PathName(user + "/file")
+	)
+	l, err := newClog(config.New(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newClog: %s", err)
+	}
+	defer l.close()
+
+	fake := newFakeLocalWatcher()
+	p := newProxiedDirs(l, Config{IdleTimeout: time.Hour, ScanPeriod: time.Hour})
+	p.newLocalWatcher = func() LocalWatcher { return fake }
+	defer p.close()
+
+	ep := &upspin.Endpoint{Transport: upspin.InProcess}
+	p.proxyFor(name, ep)
+
+	p.Lock()
+	d := p.m[user]
+	p.Unlock()
+	if d == nil || d.die == nil {
+		t.Fatal("proxyFor did not start a watcher")
+	}
+
+	p.SetLocalRoot(user, "/mnt/joe")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.Lock()
+		attached := d.local != nil
+		p.Unlock()
+		if attached {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("SetLocalRoot never attached a LocalWatcher to the running watcher")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+// This file implements a background reaper that shuts down watchers
+// for directories nobody has looked at in a while, and evicts the LRU
+// entries they back, so a long-lived dircache doesn't keep a Watch open
+// (and stale data cached) for every user who has ever touched it. The
+// watcher and cached state are transparently rebuilt the next time
+// proxyFor is called for that user; see the reaped field on proxiedDir.
+
+import (
+	"time"
+
+	"upspin.io/log"
+	"upspin.io/upspin"
+)
+
+// Config controls the idle-watcher reaper.
+type Config struct {
+	// IdleTimeout is how long a directory may go unaccessed before its
+	// watcher is closed and its LRU entries evicted.
+	IdleTimeout time.Duration
+
+	// ScanPeriod is how often the reaper looks for idle directories.
+	ScanPeriod time.Duration
+
+	// PerUser overrides IdleTimeout for specific users.
+	PerUser map[upspin.UserName]time.Duration
+
+	// RefreshInterval is how often a running watcher pings its
+	// DirServer to assert liveness of its Watch subscription. See
+	// refreshWatch in refresh.go.
+	RefreshInterval time.Duration
+}
+
+const (
+	defaultIdleTimeout     = 24 * time.Hour
+	defaultScanPeriod      = time.Hour
+	defaultRefreshInterval = 5 * time.Minute
+)
+
+// setDefaults fills in zero-valued fields with the package defaults.
+func (cfg *Config) setDefaults() {
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultIdleTimeout
+	}
+	if cfg.ScanPeriod == 0 {
+		cfg.ScanPeriod = defaultScanPeriod
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = defaultRefreshInterval
+	}
+}
+
+// idleTimeout returns the idle timeout that applies to user.
+func (cfg Config) idleTimeout(user upspin.UserName) time.Duration {
+	if t, ok := cfg.PerUser[user]; ok {
+		return t
+	}
+	return cfg.IdleTimeout
+}
+
+// reap runs until p is closed, periodically calling reapOnce.
+func (p *proxiedDirs) reap() {
+	ticker := time.NewTicker(p.cfg.ScanPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.reapDone:
+			return
+		case <-ticker.C:
+			p.reapOnce()
+		}
+	}
+}
+
+// reapOnce closes the watcher, and evicts the LRU entries, of every
+// directory whose atime is older than its idle timeout.
+func (p *proxiedDirs) reapOnce() {
+	p.Lock()
+	defer p.Unlock()
+	if p.closing {
+		return
+	}
+	now := p.now()
+	for user, d := range p.m {
+		if d.die == nil {
+			// Already idle.
+			continue
+		}
+		if now.Sub(d.atime) < p.cfg.idleTimeout(user) {
+			continue
+		}
+		log.Debug.Printf("dircache: reaping idle watcher for %s", user)
+		p.closeAsync(d)
+		d.reaped = true
+		p.l.wipeLog(user)
+	}
+}
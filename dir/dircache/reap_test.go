@@ -0,0 +1,92 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+import (
+	"testing"
+	"time"
+
+	"upspin.io/config"
+	"upspin.io/upspin"
+)
+
+// TestReapIdleWatcher simulates the passage of time with a fake clock
+// and confirms that an idle directory's watcher is closed and its LRU
+// entries evicted, and that the next access transparently resumes it
+// with a full re-read rather than serving stale cached state.
+func TestReapIdleWatcher(t *testing.T) {
+	const (
+		user upspin.UserName = "joe@upspin.io"
+		name                 = upspin.PathName(user + "/file")
+	)
+	l, err := newClog(config.New(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newClog: %s", err)
+	}
+	defer l.close()
+
+	p := newProxiedDirs(l, Config{IdleTimeout: time.Hour, ScanPeriod: time.Minute})
+	defer p.close()
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	ep := &upspin.Endpoint{Transport: upspin.InProcess}
+	p.proxyFor(name, ep)
+
+	p.Lock()
+	d := p.m[user]
+	p.Unlock()
+	if d == nil || d.die == nil {
+		t.Fatal("proxyFor did not start a watcher")
+	}
+	d.order = 7
+	l.lru.Add(lruKey{name: name, glob: false}, nil)
+
+	// Advance the clock past the idle timeout and reap.
+	now = now.Add(2 * time.Hour)
+	p.reapOnce()
+
+	p.Lock()
+	idleReaped := d.reaped
+	p.Unlock()
+	if !idleReaped {
+		t.Error("d.reaped not set after reap")
+	}
+
+	// reapOnce signals the watcher to die but, to avoid blocking the
+	// lock on it, doesn't wait for it to actually do so; give it a
+	// moment to finish before checking that it did.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.Lock()
+		die := d.die
+		p.Unlock()
+		if die == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher still running after reap")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := l.lru.Get(lruKey{name: name, glob: false}); ok {
+		t.Error("LRU entry survived reap; stale data could be served after resume")
+	}
+
+	// Access again; the watcher should restart and force a full re-read.
+	p.proxyFor(name, ep)
+	p.Lock()
+	defer p.Unlock()
+	if d.die == nil {
+		t.Error("proxyFor did not restart the reaped watcher")
+	}
+	if d.order != -1 {
+		t.Errorf("order = %d after resume, want -1 to force a full re-read", d.order)
+	}
+	if d.reaped {
+		t.Error("d.reaped still set after resume")
+	}
+}
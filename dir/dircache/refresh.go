@@ -0,0 +1,46 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+// This file implements a refresh-lease protocol layered on top of a
+// DirServer's Watch: periodically, watch asserts liveness of its
+// outstanding subscription so the cache notices a dead or failed-over
+// server without waiting for a TCP timeout. Two consecutive failed
+// refreshes tear down the current Watch and restart it at the last
+// known order.
+//
+// RefreshWatch is an optional capability: DirServer implementations
+// that don't support it (the common case today) are treated as always
+// healthy, so watch falls back to its usual TCP-timeout-bound recovery.
+
+import (
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// errRefreshLeaseExpired is returned by watch when two consecutive
+// refreshes of its Watch subscription have failed.
+var errRefreshLeaseExpired = errors.E("dir/dircache: refresh lease expired")
+
+// watchRefresher is implemented by DirServers that support refreshing
+// an outstanding Watch subscription to prove the client is still alive.
+// It is not part of the upspin.DirServer interface; servers that don't
+// implement it are simply assumed to be healthy between real events.
+type watchRefresher interface {
+	// RefreshWatch pings the server to assert liveness of the Watch
+	// subscription for user at order.
+	RefreshWatch(user upspin.UserName, order int64) error
+}
+
+// refreshWatch asserts liveness of dir's outstanding Watch subscription
+// for user at order, if dir supports it. It is a no-op, and always
+// succeeds, for servers that don't.
+func refreshWatch(dir upspin.DirServer, user upspin.UserName, order int64) error {
+	r, ok := dir.(watchRefresher)
+	if !ok {
+		return nil
+	}
+	return r.RefreshWatch(user, order)
+}
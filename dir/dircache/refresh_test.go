@@ -0,0 +1,49 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dircache
+
+import (
+	"testing"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// plainDirServer implements upspin.DirServer (minimally, for this test)
+// but not watchRefresher, representing the common case today.
+type plainDirServer struct {
+	upspin.DirServer
+}
+
+// refreshingDirServer additionally implements watchRefresher.
+type refreshingDirServer struct {
+	upspin.DirServer
+	err error
+}
+
+func (r *refreshingDirServer) RefreshWatch(user upspin.UserName, order int64) error {
+	return r.err
+}
+
+func TestRefreshWatchNoOpWithoutSupport(t *testing.T) {
+	if err := refreshWatch(plainDirServer{}, "joe@upspin.io", 42); err != nil {
+		t.Errorf("refreshWatch on an unsupporting DirServer: got %s, want nil", err)
+	}
+}
+
+func TestRefreshWatchPropagatesFailure(t *testing.T) {
+	want := errors.E("refresh failed")
+	dir := &refreshingDirServer{err: want}
+	if got := refreshWatch(dir, "joe@upspin.io", 42); got != want {
+		t.Errorf("refreshWatch = %v, want %v", got, want)
+	}
+}
+
+func TestRefreshWatchSucceeds(t *testing.T) {
+	dir := &refreshingDirServer{}
+	if err := refreshWatch(dir, "joe@upspin.io", 42); err != nil {
+		t.Errorf("refreshWatch = %s, want nil", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symm
+
+// This file adds optional per-block compression to the SymmPack
+// pipeline. Pack compresses a block before sealing it, so that large
+// text and log files produce substantially smaller ciphertext; Unpack
+// reverses the process after opening the AEAD seal, so authentication
+// is always computed over the compressed bytes rather than the
+// cleartext, which avoids giving an attacker a CRIME-style compression
+// oracle.
+//
+// Each sealed block is:
+//
+//	[1-byte algorithm ID][varint uncompressed length][payload]
+//
+// If compressing a block doesn't make it smaller, the raw bytes are
+// stored instead with the algorithm ID set to compressNone, so
+// compression never costs more than the one-byte-plus-varint header.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+
+	"upspin.io/errors"
+)
+
+// compressionAlgo identifies the compressor applied to a single block.
+// It is also stored once in Packdata to record which algorithm Pack
+// preferred for this file; Unpack dispatches on the per-block ID it
+// reads out of each block's header, not on the Packdata byte, since an
+// individual block may have been stored raw.
+type compressionAlgo byte
+
+const (
+	compressNone compressionAlgo = iota
+	compressZstd
+	compressGzip
+)
+
+// defaultCompression is the algorithm new packs request.
+const defaultCompression = compressZstd
+
+// defaultMaxUncompressedBlockLen is the default value of
+// maxUncompressedBlockLen: 64MB, well above any block size in use.
+const defaultMaxUncompressedBlockLen = 64 << 20
+
+// maxUncompressedBlockLen bounds the uncompressed length a block may
+// declare. decompressBlock refuses to decompress anything larger, so a
+// corrupt or hostile length can't be used to force an unbounded
+// allocation. It starts at defaultMaxUncompressedBlockLen; a server
+// expecting unusually large blocks can raise it with
+// SetMaxUncompressedBlockLen. It's a package-wide setting, accessed
+// atomically, because symmPacker is registered once via pack.Register
+// and shared by every Context, rather than constructed per caller.
+var maxUncompressedBlockLen = int64(defaultMaxUncompressedBlockLen)
+
+// SetMaxUncompressedBlockLen overrides the cap decompressBlock enforces
+// on a block's declared uncompressed length.
+func SetMaxUncompressedBlockLen(n int64) {
+	atomic.StoreInt64(&maxUncompressedBlockLen, n)
+}
+
+// compressor is the pluggable interface a compression backend
+// implements. Registering a new one (e.g. snappy) only requires adding
+// an entry to compressors and a new compressionAlgo constant.
+//
+// decompress must itself enforce max, the cap currently in
+// maxUncompressedBlockLen, by bounding however it decodes rather than
+// materializing the full output and checking its length afterward: a
+// block can lie about its declared uncompressed length (see
+// decompressBlock), so the only safe place to stop a decompression bomb
+// is inside decompression itself.
+type compressor interface {
+	compress(in []byte) ([]byte, error)
+	decompress(in []byte, max int64) ([]byte, error)
+}
+
+var compressors = map[compressionAlgo]compressor{
+	compressZstd: zstdCompressor{},
+	compressGzip: gzipCompressor{},
+}
+
+// compressBlock returns the bytes to seal for a block: the requested
+// algorithm's output if it's smaller than raw, otherwise the raw bytes
+// tagged compressNone.
+func compressBlock(algo compressionAlgo, cleartext []byte) ([]byte, error) {
+	header := make([]byte, 0, 1+binary.MaxVarintLen64)
+	header = append(header, byte(compressNone))
+	header = appendVarint(header, len(cleartext))
+	raw := append(header, cleartext...)
+
+	if algo == compressNone {
+		return raw, nil
+	}
+	c, ok := compressors[algo]
+	if !ok {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("symm: unknown compression algorithm %d", algo))
+	}
+	compressed, err := c.compress(cleartext)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(cleartext) {
+		// Didn't pay for itself; store raw instead.
+		return raw, nil
+	}
+	out := make([]byte, 0, 1+binary.MaxVarintLen64+len(compressed))
+	out = append(out, byte(algo))
+	out = appendVarint(out, len(cleartext))
+	out = append(out, compressed...)
+	return out, nil
+}
+
+// decompressBlock reverses compressBlock.
+func decompressBlock(payload []byte) ([]byte, error) {
+	if len(payload) == 0 {
+		return nil, errors.E(errors.Invalid, "symm: empty block payload")
+	}
+	algo := compressionAlgo(payload[0])
+	uncompressedLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return nil, errors.E(errors.Invalid, "symm: malformed block header")
+	}
+	max := atomic.LoadInt64(&maxUncompressedBlockLen)
+	if uncompressedLen > uint64(max) {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("symm: block declares %d uncompressed bytes, over the %d cap", uncompressedLen, max))
+	}
+	body := payload[1+n:]
+	if algo == compressNone {
+		return body, nil
+	}
+	c, ok := compressors[algo]
+	if !ok {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("symm: unknown compression algorithm %d", algo))
+	}
+	cleartext, err := c.decompress(body, max)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(cleartext)) != uncompressedLen {
+		return nil, errors.E(errors.Invalid, "symm: decompressed length mismatch")
+	}
+	return cleartext, nil
+}
+
+func appendVarint(b []byte, n int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	m := binary.PutUvarint(buf[:], uint64(n))
+	return append(b, buf[:m]...)
+}
+
+// zstdCompressor is the default compressor: a fast, high-ratio codec
+// well suited to the text and log files this feature targets.
+type zstdCompressor struct{}
+
+func (zstdCompressor) compress(in []byte) ([]byte, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(in, nil), nil
+}
+
+func (zstdCompressor) decompress(in []byte, max int64) ([]byte, error) {
+	// WithDecoderMaxMemory bounds the window and output buffers zstd
+	// allocates while decoding, so it errors out partway through a
+	// bomb instead of materializing it first and failing the
+	// declared-length check afterward.
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max)))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	return dec.DecodeAll(in, nil)
+}
+
+// gzipCompressor demonstrates that the registry isn't zstd-specific;
+// it's otherwise unused by this packing.
+type gzipCompressor struct{}
+
+func (gzipCompressor) compress(in []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(in); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) decompress(in []byte, max int64) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(in))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// gzip has no built-in output cap, unlike zstd's
+	// WithDecoderMaxMemory, so enforce one with a limited reader: read
+	// one byte past max and treat getting it as proof the real output
+	// exceeds the cap, without ever materializing more than max+1
+	// bytes of a bomb.
+	out, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > max {
+		return nil, errors.E(errors.Invalid, fmt.Sprintf("symm: decompressed block exceeds the %d-byte cap", max))
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, algo := range []compressionAlgo{compressNone, compressZstd, compressGzip} {
+		text := bytes.Repeat([]byte("hello, upspin\n"), 1000)
+		packed, err := compressBlock(algo, text)
+		if err != nil {
+			t.Fatalf("algo %d: compressBlock: %s", algo, err)
+		}
+		got, err := decompressBlock(packed)
+		if err != nil {
+			t.Fatalf("algo %d: decompressBlock: %s", algo, err)
+		}
+		if !bytes.Equal(got, text) {
+			t.Fatalf("algo %d: round trip mismatch", algo)
+		}
+	}
+}
+
+// TestCompressFallsBackToRaw confirms that incompressible data, which
+// would grow under compression, is instead stored raw with the
+// compressNone tag.
+func TestCompressFallsBackToRaw(t *testing.T) {
+	random := make([]byte, 4096)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	packed, err := compressBlock(compressZstd, random)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressionAlgo(packed[0]) != compressNone {
+		t.Errorf("algorithm byte = %d, want compressNone for incompressible data", packed[0])
+	}
+	got, err := decompressBlock(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, random) {
+		t.Fatal("round trip mismatch for raw fallback")
+	}
+}
+
+func TestDecompressRejectsOversizedLength(t *testing.T) {
+	header := make([]byte, 0, 1+binary.MaxVarintLen64)
+	header = append(header, byte(compressZstd))
+	header = appendVarint(header, int(defaultMaxUncompressedBlockLen)+1)
+	if _, err := decompressBlock(header); err == nil {
+		t.Fatal("expected error for a declared length over the cap")
+	}
+}
+
+// TestDecompressBombIsCapped confirms that a block which lies about a
+// small declared uncompressed length, but whose compressed payload
+// actually decodes to something far larger than the cap, is still
+// rejected: the declared-length check alone can't catch this, so the
+// cap has to be enforced by the decompressor itself.
+func TestDecompressBombIsCapped(t *testing.T) {
+	defer SetMaxUncompressedBlockLen(defaultMaxUncompressedBlockLen)
+	SetMaxUncompressedBlockLen(1024)
+
+	bomb := bytes.Repeat([]byte{0}, 1<<20) // compresses tiny, decodes huge
+	for _, algo := range []compressionAlgo{compressZstd, compressGzip} {
+		c := compressors[algo]
+		compressed, err := c.compress(bomb)
+		if err != nil {
+			t.Fatalf("algo %d: compress: %s", algo, err)
+		}
+		header := make([]byte, 0, 1+binary.MaxVarintLen64)
+		header = append(header, byte(algo))
+		header = appendVarint(header, 10) // lie: declare far under the real size
+		payload := append(header, compressed...)
+		if _, err := decompressBlock(payload); err == nil {
+			t.Fatalf("algo %d: expected an error decompressing a block whose real size exceeds the cap", algo)
+		}
+	}
+}
+
+// TestSetMaxUncompressedBlockLen confirms the cap decompressBlock
+// enforces can be lowered and raised at runtime, rather than being
+// fixed at defaultMaxUncompressedBlockLen.
+func TestSetMaxUncompressedBlockLen(t *testing.T) {
+	defer SetMaxUncompressedBlockLen(defaultMaxUncompressedBlockLen)
+
+	header := make([]byte, 0, 1+binary.MaxVarintLen64)
+	header = append(header, byte(compressNone))
+	header = appendVarint(header, 100)
+	header = append(header, make([]byte, 100)...)
+
+	SetMaxUncompressedBlockLen(100)
+	if _, err := decompressBlock(header); err != nil {
+		t.Fatalf("decompressBlock with cap == declared length: %s", err)
+	}
+
+	SetMaxUncompressedBlockLen(99)
+	if _, err := decompressBlock(header); err == nil {
+		t.Fatal("expected error once the cap was lowered below the declared length")
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package symm
+
+// This file implements multi-recipient sharing of a SymmPack file's data
+// key, mirroring the scheme pack/eepack uses: the key is wrapped once per
+// authorized reader, using a secret derived from an ECDH exchange with
+// that reader's ee public key, so any one of them can recover it
+// independently. Packdata records the writer's public key once,
+// alongside one wrappedKey per reader; Share rewraps the list, and
+// Unshare drops a reader's record from it, when the Access file's reader
+// set changes, without touching the already-sealed block data.
+//
+// Wrapping a key for a reader is a public operation: wrapFor generates a
+// fresh ephemeral key pair on the reader's curve and computes the ECDH
+// secret between the ephemeral private key and the reader's public key,
+// the same way eepack does. No private key of the writer's is involved,
+// so wrapFor needs nothing from the caller but the reader's public key.
+// The reader later recovers the identical secret from the ephemeral
+// public key (recorded alongside their wrapped record) and their own
+// private key, via Factotum.ScalarMult, without that private key ever
+// leaving the factotum. The writer's public key is still recorded in
+// Packdata, but only so Share can check that whoever is asking to rewrap
+// is the file's writer; it plays no role in the cryptography.
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"strings"
+
+	"upspin.io/errors"
+	"upspin.io/upspin"
+)
+
+// wrappedKeyNonceLen is the size, in bytes, of the per-record AEAD nonce
+// stored alongside each wrapped key (see wrappedKey.nonce).
+const wrappedKeyNonceLen = 12
+
+// wrappedKey is a file's data key, wrapped for a single reader.
+type wrappedKey struct {
+	// hash identifies the reader this record is wrapped for, so Unpack
+	// can find its own record without attempting every one. It also
+	// doubles as the keyHash argument to that reader's
+	// Factotum.ScalarMult, the same way pack/eepack selects which of a
+	// factotum's keys (current or previous) to use.
+	hash [sha256.Size]byte
+
+	// ephemeral is the uncompressed-point encoding (as produced by
+	// elliptic.Marshal) of the one-time public key wrapFor generated
+	// for this record. The reader combines it with their own private
+	// key to recover the same ECDH secret wrapFor derived from it and
+	// their public key; see wrapFor and unwrapFrom.
+	ephemeral []byte
+
+	// nonce is a value chosen fresh for this record, so that
+	// wrapped-key records produced for the same reader across
+	// different files (or across successive Share calls for the same
+	// file) never reuse a nonce under the ECDH-derived wrapping key.
+	nonce [wrappedKeyNonceLen]byte
+
+	// wrapped is the data key sealed with AES-256-GCM (via newAEAD)
+	// under a key derived from the ECDH secret shared between the
+	// ephemeral key and this reader. It is not an RFC 3394 AES key
+	// wrap.
+	wrapped []byte
+}
+
+// keyHash identifies the holder of pub in Packdata, the same way
+// pack/eepack identifies readers: by the SHA-256 of their public key.
+func keyHash(pub upspin.PublicKey) [sha256.Size]byte {
+	return sha256.Sum256([]byte(pub))
+}
+
+// parsePublicKey decodes the curve and coordinates out of pub's string
+// encoding, "<curve name>\n<x>\n<y>\n" in decimal, the same format
+// Factotum.PublicKey produces.
+func parsePublicKey(pub upspin.PublicKey) (curve elliptic.Curve, x, y *big.Int, err error) {
+	fields := strings.Fields(string(pub))
+	if len(fields) != 3 {
+		return nil, nil, nil, errors.E(errors.Invalid, "symm: malformed public key")
+	}
+	switch fields[0] {
+	case "p256":
+		curve = elliptic.P256()
+	case "p384":
+		curve = elliptic.P384()
+	case "p521":
+		curve = elliptic.P521()
+	default:
+		return nil, nil, nil, errors.E(errors.Invalid, "symm: unknown key type "+fields[0])
+	}
+	x, ok := new(big.Int).SetString(fields[1], 10)
+	if !ok {
+		return nil, nil, nil, errors.E(errors.Invalid, "symm: malformed public key")
+	}
+	y, ok = new(big.Int).SetString(fields[2], 10)
+	if !ok {
+		return nil, nil, nil, errors.E(errors.Invalid, "symm: malformed public key")
+	}
+	if !curve.IsOnCurve(x, y) {
+		return nil, nil, nil, errors.E(errors.Invalid, "symm: public key not on its curve")
+	}
+	return curve, x, y, nil
+}
+
+// wrapFor wraps dkey for the holder of pub. It needs no private key of
+// its own: it generates a one-time ephemeral key pair on pub's curve and
+// derives the wrapping key from the ECDH secret between the ephemeral
+// private key and pub, exactly as pack/eepack does. Only pub's holder,
+// combining the recorded ephemeral public key with their own private
+// key via Factotum.ScalarMult, can derive that same secret back; see
+// unwrapFrom.
+func wrapFor(pub upspin.PublicKey, dkey []byte) (wrappedKey, error) {
+	curve, x, y, err := parsePublicKey(pub)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	ephPriv, ephX, ephY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	sx, _ := curve.ScalarMult(x, y, ephPriv)
+	aead, err := newAEAD(kdf(sx.Bytes()))
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	var nonce [wrappedKeyNonceLen]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return wrappedKey{}, err
+	}
+	wrapped := aead.Seal(nonce[:0:0], nonce[:], dkey, nil)
+	return wrappedKey{
+		hash:      keyHash(pub),
+		ephemeral: elliptic.Marshal(curve, ephX, ephY),
+		nonce:     nonce,
+		wrapped:   wrapped,
+	}, nil
+}
+
+// unwrapFrom finds the record in keys wrapped for f's own public key and
+// recovers the data key from it. It derives the same ECDH secret
+// wrapFor did, between the record's ephemeral public key and f's own
+// private key, via Factotum.ScalarMult: ECDH secrets agree regardless of
+// which side's private key (ephemeral or f's) is multiplied against the
+// other's public point.
+func unwrapFrom(f upspin.Factotum, keys []wrappedKey) ([]byte, error) {
+	curve, _, _, err := parsePublicKey(f.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	h := keyHash(f.PublicKey())
+	for _, wk := range keys {
+		if wk.hash != h {
+			continue
+		}
+		ephX, ephY := elliptic.Unmarshal(curve, wk.ephemeral)
+		if ephX == nil {
+			return nil, errors.E(errors.Invalid, "symm: malformed ephemeral key")
+		}
+		sx, _ := f.ScalarMult(wk.hash[:], curve, ephX, ephY)
+		aead, err := newAEAD(kdf(sx.Bytes()))
+		if err != nil {
+			return nil, err
+		}
+		return aead.Open(nil, wk.nonce[:], wk.wrapped, nil)
+	}
+	return nil, errors.E(errors.NotExist, "symm: no wrapped key for this reader")
+}
+
+// kdf derives an AES-256 wrapping key from an ECDH shared secret.
+func kdf(secret []byte) []byte {
+	h := sha256.Sum256(secret)
+	return h[:]
+}
+
+// rewrap replaces the wrapped-key list in *pd with one record per reader
+// in readers, by unwrapping the existing data key and rewrapping it for
+// each of readers. Bulk block data is never touched.
+//
+// Only the writer may call this: rewrapping doesn't need the writer's
+// private key (wrapFor needs no private key at all), but ctx must still
+// hold the writer's factotum so unwrapFrom can recover the current data
+// key from the writer's own wrapped-key record.
+func rewrap(ctx upspin.Context, readers []upspin.PublicKey, pd *[]byte) error {
+	keys, writerPub, algo, err := decodePackdata(*pd)
+	if err != nil {
+		return err
+	}
+	f := ctx.Factotum()
+	if f.PublicKey() != writerPub {
+		return errors.E(errors.Permission, "symm: only the writer can share")
+	}
+	dkey, err := unwrapFrom(f, keys)
+	if err != nil {
+		return err
+	}
+	newKeys := make([]wrappedKey, 0, len(readers))
+	for _, pub := range readers {
+		wk, err := wrapFor(pub, dkey)
+		if err != nil {
+			return err
+		}
+		newKeys = append(newKeys, wk)
+	}
+	*pd = encodePackdata(newKeys, writerPub, algo)
+	return nil
+}
+
+// Share rewraps the data key recorded in packdata for exactly readers,
+// replacing the previous wrapped-key list. The caller's factotum must
+// be the file's writer.
+func Share(ctx upspin.Context, readers []upspin.PublicKey, packdata *[]byte) error {
+	return rewrap(ctx, readers, packdata)
+}
+
+// Unshare removes reader's wrapped-key record from packdata, if present,
+// leaving every other reader's record untouched. Unlike Share, it
+// requires no access to the data key: revoking a reader never needs to
+// decrypt anything.
+func Unshare(reader upspin.PublicKey, packdata *[]byte) error {
+	keys, writerPub, algo, err := decodePackdata(*packdata)
+	if err != nil {
+		return err
+	}
+	h := keyHash(reader)
+	kept := keys[:0]
+	for _, wk := range keys {
+		if wk.hash == h {
+			continue
+		}
+		kept = append(kept, wk)
+	}
+	*packdata = encodePackdata(kept, writerPub, algo)
+	return nil
+}
+
+// encodePackdata records, once per file, the compression algorithm Pack
+// preferred for this file's blocks, the writer's public key (recorded so
+// Share can confirm who's allowed to rewrap; see rewrap), and the list
+// of wrapped data keys, one per authorized reader.
+//
+//	[1-byte algo][varint writerPub length][writerPub bytes]
+//	[varint key count][per key: 32-byte hash][varint ephemeral length][ephemeral bytes][12-byte nonce][varint wrapped length][wrapped bytes]
+func encodePackdata(keys []wrappedKey, writerPub upspin.PublicKey, algo compressionAlgo) []byte {
+	out := make([]byte, 0, 1+binary.MaxVarintLen64+len(writerPub)+binary.MaxVarintLen64+len(keys)*(sha256.Size+wrappedKeyNonceLen+2*binary.MaxVarintLen64))
+	out = append(out, byte(algo))
+	out = appendVarint(out, len(writerPub))
+	out = append(out, writerPub...)
+	out = appendVarint(out, len(keys))
+	for _, wk := range keys {
+		out = append(out, wk.hash[:]...)
+		out = appendVarint(out, len(wk.ephemeral))
+		out = append(out, wk.ephemeral...)
+		out = append(out, wk.nonce[:]...)
+		out = appendVarint(out, len(wk.wrapped))
+		out = append(out, wk.wrapped...)
+	}
+	return out
+}
+
+// minWrappedKeyLen is the smallest number of bytes a single wrappedKey
+// record could possibly take in its encoded form: a hash, a one-byte
+// varint for a (degenerate, empty) ephemeral key, a nonce, and a
+// one-byte varint for a (degenerate, empty) wrapped key.
+const minWrappedKeyLen = sha256.Size + 1 + wrappedKeyNonceLen + 1
+
+// decodePackdata reverses encodePackdata.
+func decodePackdata(packdata []byte) (keys []wrappedKey, writerPub upspin.PublicKey, algo compressionAlgo, err error) {
+	if len(packdata) < 1 {
+		return nil, "", 0, errors.E(errors.Invalid, "symm: empty Packdata")
+	}
+	algo = compressionAlgo(packdata[0])
+	rest := packdata[1:]
+	pubLen, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, "", 0, errors.E(errors.Invalid, "symm: malformed Packdata")
+	}
+	rest = rest[n:]
+	if uint64(len(rest)) < pubLen {
+		return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+	}
+	writerPub = upspin.PublicKey(rest[:pubLen])
+	rest = rest[pubLen:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, "", 0, errors.E(errors.Invalid, "symm: malformed Packdata")
+	}
+	rest = rest[n:]
+	// Every record costs at least minWrappedKeyLen bytes, even before
+	// its variable-length fields; reject a count that couldn't
+	// possibly fit in what's left before trusting it as an allocation
+	// size, so a corrupt or hostile Packdata can't make count huge and
+	// crash the process here.
+	if count > uint64(len(rest))/minWrappedKeyLen {
+		return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+	}
+	keys = make([]wrappedKey, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(rest) < sha256.Size {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+		}
+		var wk wrappedKey
+		copy(wk.hash[:], rest[:sha256.Size])
+		rest = rest[sha256.Size:]
+
+		ephLen, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: malformed Packdata")
+		}
+		rest = rest[n:]
+		if uint64(len(rest)) < ephLen {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+		}
+		wk.ephemeral = rest[:ephLen]
+		rest = rest[ephLen:]
+
+		if len(rest) < wrappedKeyNonceLen {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+		}
+		copy(wk.nonce[:], rest[:wrappedKeyNonceLen])
+		rest = rest[wrappedKeyNonceLen:]
+
+		wrappedLen, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: malformed Packdata")
+		}
+		rest = rest[n:]
+		if uint64(len(rest)) < wrappedLen {
+			return nil, "", 0, errors.E(errors.Invalid, "symm: truncated Packdata")
+		}
+		wk.wrapped = rest[:wrappedLen]
+		rest = rest[wrappedLen:]
+		keys = append(keys, wk)
+	}
+	return keys, writerPub, algo, nil
+}
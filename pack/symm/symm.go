@@ -0,0 +1,215 @@
+// Copyright 2016 The Upspin Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package symm implements the upspin.SymmPack packing, which encrypts
+// and authenticates data with a single symmetric key per file. That key
+// is wrapped once per authorized reader, using ECDH with the reader's
+// ee public key, so any of them can recover it without the others'
+// cooperation; see share.go.
+package symm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"upspin.io/errors"
+	"upspin.io/log"
+	"upspin.io/pack"
+	"upspin.io/upspin"
+)
+
+// symmKeyLen is the size, in bytes, of the per-file data key, an
+// AES-256 key.
+const symmKeyLen = 32
+
+func init() {
+	pack.Register(symmPacker{})
+}
+
+type symmPacker struct{}
+
+var _ upspin.Packer = symmPacker{}
+
+func (symmPacker) Packing() upspin.Packing { return upspin.SymmPack }
+
+func (symmPacker) Name() string { return "symm" }
+
+// PackLength is not knowable in advance: compression (see compress.go)
+// may shrink each block by a different amount, so callers must size
+// their buffers from the ciphertext they actually receive.
+func (symmPacker) PackLength(ctx upspin.Context, d *upspin.DirEntry) int {
+	return -1
+}
+
+// ReaderHashes implements upspin.Packer. It returns, for each reader
+// currently able to unwrap this file's data key, the hash that
+// identifies them in Packdata.
+func (symmPacker) ReaderHashes(packdata []byte) ([][]byte, error) {
+	keys, _, _, err := decodePackdata(packdata)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([][]byte, len(keys))
+	for i, wk := range keys {
+		h := wk.hash
+		hashes[i] = h[:]
+	}
+	return hashes, nil
+}
+
+// Share implements upspin.Packer. For each entry, it rewraps the file's
+// data key for exactly readers, without touching the already-encrypted
+// block data. See rewrap.
+func (symmPacker) Share(ctx upspin.Context, readers []upspin.PublicKey, packdata []*[]byte) {
+	for _, pd := range packdata {
+		if pd == nil || len(*pd) == 0 {
+			continue
+		}
+		if err := rewrap(ctx, readers, pd); err != nil {
+			log.Error.Printf("pack/symm.Share: %s", err)
+			*pd = nil
+		}
+	}
+}
+
+// Pack implements upspin.Packer. It wraps the new data key for the
+// writer alone; Share (called once the Access file's reader list is
+// known) wraps it for everyone else authorized to read the file.
+func (symmPacker) Pack(ctx upspin.Context, d *upspin.DirEntry) (upspin.BlockPacker, error) {
+	const op = "pack/symm.Pack"
+	if d.IsDir() {
+		return nil, errors.E(op, d.Name, errors.IsDir, "cannot pack directories")
+	}
+
+	dkey := make([]byte, symmKeyLen)
+	if _, err := rand.Read(dkey); err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+
+	f := ctx.Factotum()
+	wk, err := wrapFor(f.PublicKey(), dkey)
+	if err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+
+	aead, err := newAEAD(dkey)
+	if err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+
+	d.Packdata = encodePackdata([]wrappedKey{wk}, f.PublicKey(), defaultCompression)
+
+	return &blockPacker{
+		entry: d,
+		aead:  aead,
+		algo:  defaultCompression,
+	}, nil
+}
+
+// Unpack implements upspin.Packer.
+func (symmPacker) Unpack(ctx upspin.Context, d *upspin.DirEntry) (upspin.BlockUnpacker, error) {
+	const op = "pack/symm.Unpack"
+	if d.Packing != upspin.SymmPack {
+		return nil, errors.E(op, d.Name, errors.Invalid, "wrong packing type")
+	}
+
+	keys, _, _, err := decodePackdata(d.Packdata)
+	if err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+	f := ctx.Factotum()
+	dkey, err := unwrapFrom(f, keys)
+	if err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+	aead, err := newAEAD(dkey)
+	if err != nil {
+		return nil, errors.E(op, d.Name, err)
+	}
+
+	return &blockUnpacker{
+		entry:  d,
+		aead:   aead,
+		blocks: d.Blocks,
+	}, nil
+}
+
+// newAEAD returns the AES-256-GCM instance used to seal and open blocks
+// under the per-file data key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blockNonce derives a deterministic, unique nonce for block index i so
+// that no nonce is ever reused under the same key: the GCM standard
+// nonce is 12 bytes, so we simply encode the block index into it.
+func blockNonce(i int) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(i))
+	return nonce
+}
+
+// blockPacker implements upspin.BlockPacker for SymmPack.
+type blockPacker struct {
+	entry *upspin.DirEntry
+	aead  cipher.AEAD
+	algo  compressionAlgo
+	index int
+}
+
+// Pack implements upspin.BlockPacker.
+func (bp *blockPacker) Pack(cleartext []byte) ([]byte, error) {
+	const op = "pack/symm.blockPacker.Pack"
+	payload, err := compressBlock(bp.algo, cleartext)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	nonce := blockNonce(bp.index)
+	bp.index++
+	return bp.aead.Seal(nonce[:0:0], nonce, payload, nil), nil
+}
+
+// SetLocation implements upspin.BlockPacker.
+func (bp *blockPacker) SetLocation(l upspin.Location) {
+	bp.entry.Blocks = append(bp.entry.Blocks, upspin.DirBlock{Location: l})
+}
+
+// Close implements upspin.BlockPacker.
+func (bp *blockPacker) Close() error {
+	return nil
+}
+
+// blockUnpacker implements upspin.BlockUnpacker for SymmPack.
+type blockUnpacker struct {
+	entry  *upspin.DirEntry
+	aead   cipher.AEAD
+	blocks []upspin.DirBlock
+	index  int
+}
+
+// NextBlock implements upspin.BlockUnpacker.
+func (bu *blockUnpacker) NextBlock() (upspin.DirBlock, bool) {
+	if bu.index >= len(bu.blocks) {
+		return upspin.DirBlock{}, false
+	}
+	return bu.blocks[bu.index], true
+}
+
+// Unpack implements upspin.BlockUnpacker.
+func (bu *blockUnpacker) Unpack(ciphertext []byte) ([]byte, error) {
+	const op = "pack/symm.blockUnpacker.Unpack"
+	nonce := blockNonce(bu.index)
+	bu.index++
+	payload, err := bu.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.E(op, bu.entry.Name, err)
+	}
+	return decompressBlock(payload)
+}
@@ -90,23 +90,80 @@ func testPackAndUnpack(t *testing.T, ctx upspin.Context, packer upspin.Packer, n
 	}
 }
 
+// TestBadkeyPack confirms that a user who hasn't been given a wrapped
+// copy of a file's data key can't Unpack it. Packing itself no longer
+// depends on any local secret: Pack only ever wraps the new key for the
+// writer, so every user with a factotum can pack their own files.
 func TestBadkeyPack(t *testing.T) {
 	const (
-		user upspin.UserName = "carla@upspin.io"
-		name                 = upspin.PathName(user + "/file/of/carla")
+		writer upspin.UserName = "joe@upspin.io"
+		other  upspin.UserName = "carla@upspin.io"
+		name                   = upspin.PathName(writer + "/file/of/joe")
+		text                   = "this is some text"
 	)
-	ctx, packer := setup(user)
+	wctx, packer := setup(writer)
 	d := &upspin.DirEntry{
 		Name:       name,
 		SignedName: name,
-		Writer:     ctx.UserName(),
+		Writer:     wctx.UserName(),
 	}
-	d.Packing = packer.Packing()
-	_, err := packer.Pack(ctx, d)
-	if errors.Match(errors.E(errors.NotExist), err) {
-		return // User carla has no symmsecret.upspinkey, so this err is expected.
+	packBlob(t, wctx, packer, d, []byte(text))
+
+	octx, _ := setup(other)
+	if _, err := packer.Unpack(octx, d); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Fatalf("Unpack by a user never given the key: got %v, want errors.NotExist", err)
+	}
+}
+
+// TestShareAddsReadersAndUnshareRevokesThem packs a file as joe, shares
+// it with carla and aly, and confirms both can independently unpack it.
+// Revoking aly then invalidates only her copy of the key; carla's is
+// unaffected.
+func TestShareAddsReadersAndUnshareRevokesThem(t *testing.T) {
+	const (
+		writer               = upspin.UserName("joe@upspin.io")
+		reader1              = upspin.UserName("carla@upspin.io")
+		reader2              = upspin.UserName("aly@upspin.io")
+		name                 = upspin.PathName(writer + "/file/of/joe")
+		text                 = "shared among several readers"
+	)
+	wctx, packer := setup(writer)
+	r1ctx, _ := setup(reader1)
+	r2ctx, _ := setup(reader2)
+
+	d := &upspin.DirEntry{
+		Name:       name,
+		SignedName: name,
+		Writer:     wctx.UserName(),
+	}
+	cipher := packBlob(t, wctx, packer, d, []byte(text))
+
+	readers := []upspin.PublicKey{
+		wctx.Factotum().PublicKey(),
+		r1ctx.Factotum().PublicKey(),
+		r2ctx.Factotum().PublicKey(),
+	}
+	if err := Share(wctx, readers, &d.Packdata); err != nil {
+		t.Fatal("Share:", err)
+	}
+
+	if got := unpackBlob(t, r1ctx, packer, d, cipher); string(got) != text {
+		t.Errorf("carla unpacked %q, want %q", got, text)
+	}
+	if got := unpackBlob(t, r2ctx, packer, d, cipher); string(got) != text {
+		t.Errorf("aly unpacked %q, want %q", got, text)
+	}
+
+	if err := Unshare(r2ctx.Factotum().PublicKey(), &d.Packdata); err != nil {
+		t.Fatal("Unshare:", err)
+	}
+
+	if _, err := packer.Unpack(r2ctx, d); !errors.Match(errors.E(errors.NotExist), err) {
+		t.Errorf("aly unpack after revocation: got %v, want errors.NotExist", err)
+	}
+	if got := unpackBlob(t, r1ctx, packer, d, cipher); string(got) != text {
+		t.Errorf("carla unpack after aly's revocation: got %q, want %q", got, text)
 	}
-	t.Error("BadkeyPack:", err)
 }
 
 func TestPack(t *testing.T) {
@@ -120,8 +177,13 @@ func TestPack(t *testing.T) {
 }
 
 func benchmarkPack(b *testing.B, fileSize int, unpack bool) {
-	b.SetBytes(int64(fileSize))
-	const user upspin.UserName = "joe@upspin.io"
+	benchmarkPackData(b, randomData(b, fileSize), unpack)
+}
+
+// randomData returns fileSize bytes of high-entropy data, representative
+// of content (e.g. already-compressed media) that compression won't
+// help and that Pack is expected to store raw.
+func randomData(b *testing.B, fileSize int) []byte {
 	data := make([]byte, fileSize)
 	n, err := rand.Read(data)
 	if err != nil {
@@ -130,7 +192,24 @@ func benchmarkPack(b *testing.B, fileSize int, unpack bool) {
 	if n != fileSize {
 		b.Fatalf("Not enough random bytes read: %d", n)
 	}
-	data = data[:n]
+	return data[:n]
+}
+
+// compressibleData returns fileSize bytes of repetitive text,
+// representative of the logs and source files this feature targets.
+func compressibleData(fileSize int) []byte {
+	const line = "the quick brown fox jumps over the lazy dog\n"
+	data := make([]byte, 0, fileSize)
+	for len(data) < fileSize {
+		data = append(data, line...)
+	}
+	return data[:fileSize]
+}
+
+func benchmarkPackData(b *testing.B, data []byte, unpack bool) {
+	fileSize := len(data)
+	b.SetBytes(int64(fileSize))
+	const user upspin.UserName = "joe@upspin.io"
 	name := upspin.PathName(fmt.Sprintf("%s/file/of/user.%d", user, packing))
 	ctx, packer := setup(user)
 	for i := 0; i < b.N; i++ {
@@ -178,6 +257,14 @@ func BenchmarkPack_1byte(b *testing.B)  { benchmarkPack(b, 1, !unpack) }
 func BenchmarkPack_1kbyte(b *testing.B) { benchmarkPack(b, 1024, !unpack) }
 func BenchmarkPack_1Mbyte(b *testing.B) { benchmarkPack(b, 1024*1024, !unpack) }
 
+// BenchmarkPack_1Mbyte_Compressible packs the same size file as
+// BenchmarkPack_1Mbyte, but with content compression can actually
+// shrink, to measure the cost and benefit of the compression pipeline
+// added alongside this benchmark.
+func BenchmarkPack_1Mbyte_Compressible(b *testing.B) {
+	benchmarkPackData(b, compressibleData(1024*1024), !unpack)
+}
+
 func BenchmarkPackUnpack_1byte(b *testing.B)  { benchmarkPack(b, 1, unpack) }
 func BenchmarkPackUnpack_1kbyte(b *testing.B) { benchmarkPack(b, 1024, unpack) }
 func BenchmarkPackUnpack_1Mbyte(b *testing.B) {